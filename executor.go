@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/asdine/storm"
+	"github.com/deckarep/golang-set"
+)
+
+// DefaultWorkers is the default size of the worker pool used to run the
+// tasks within a single level, unless the caller asks for a different
+// size.
+var DefaultWorkers = runtime.NumCPU()
+
+// retryBaseDelay is the backoff before the first retry of a failed
+// task; it doubles on every further attempt.
+const retryBaseDelay = 500 * time.Millisecond
+
+// Execute runs a set of leveled tasks, at most `workers` at a time
+// within each level, waiting for a whole level to finish before moving
+// on to the next one. A task only runs UpdateDepData after its action
+// returns success. If a task's action fails, every task that depends on
+// it (directly or transitively, per deps) is skipped instead of run,
+// but unrelated branches of the DAG keep making progress. Execute
+// returns an error if any task failed or was skipped because of a
+// failed dependency. If journal is non-nil, every task's start and
+// finish (with input/output hashes) is recorded to it.
+func Execute(ctx context.Context, levels Levels, deps map[string]mapset.Set, db *storm.DB, workers int, journal *RunJournal) error {
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
+
+	var mu sync.Mutex
+	failed := make(map[string]error)
+
+	failedDep := func(name string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		for dep := range deps[name].Iter() {
+			if err, ok := failed[dep.(string)]; ok {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, level := range levels {
+		sem := make(chan struct{}, workers)
+		var wg sync.WaitGroup
+
+		for _, t := range level {
+			t := t
+			if err := failedDep(t.name); err != nil {
+				mu.Lock()
+				failed[t.name] = fmt.Errorf("skipped, dependency failed: %w", err)
+				mu.Unlock()
+				continue
+			}
+
+			wg.Add(1)
+			sem <- struct{}{}
+			go func() {
+				defer wg.Done()
+				defer func() { <-sem }()
+
+				hasher := t.hasher
+				if hasher == nil {
+					hasher = DefaultHasher
+				}
+				inputs := CalculateDepData(t, db).fileHashes
+				if journal != nil {
+					if err := journal.Start(t.name, inputs); err != nil {
+						log.Printf("Error writing journal start for %s: %s", t.name, err)
+					}
+				}
+
+				attempts := t.maxAttempts
+				if attempts <= 0 {
+					attempts = 1
+				}
+
+				var err error
+				for attempt := 1; attempt <= attempts; attempt++ {
+					if t.action == nil {
+						err = nil
+						break
+					}
+					err = t.action(ctx)
+					if err == nil {
+						break
+					}
+					if attempt < attempts {
+						backoff := retryBaseDelay * time.Duration(int64(1)<<uint(attempt-1))
+						log.Printf("task %s failed (attempt %d/%d), retrying in %s: %s", t.name, attempt, attempts, backoff, err)
+						time.Sleep(backoff)
+					}
+				}
+				if err != nil {
+					log.Printf("task %s failed: %s", t.name, err)
+					mu.Lock()
+					failed[t.name] = err
+					mu.Unlock()
+					if journal != nil {
+						journal.Finish(t.name, false, err, inputs, nil)
+					}
+					return
+				}
+				UpdateDepData(t, db)
+				recordRunTime(db, t.name, time.Now())
+				if journal != nil {
+					outputs := hashPaths(t.targets, hasher, db)
+					if err := journal.Finish(t.name, true, nil, inputs, outputs); err != nil {
+						log.Printf("Error writing journal finish for %s: %s", t.name, err)
+					}
+				}
+			}()
+		}
+		wg.Wait()
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("%d task(s) failed or were skipped", len(failed))
+	}
+	return nil
+}
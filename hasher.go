@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+
+	"github.com/asdine/storm"
+	"github.com/cespare/xxhash/v2"
+	"github.com/deckarep/golang-set"
+	"github.com/zeebo/blake3"
+)
+
+// Hasher picks the algorithm used to fingerprint a file's contents.
+// Tasks can select one via Task.hasher; DefaultHasher is used otherwise.
+type Hasher interface {
+	// Name identifies the algorithm, used as part of the hash cache key.
+	Name() string
+	// New returns a fresh hash.Hash to stream file contents into.
+	New() hash.Hash
+}
+
+type md5Hasher struct{}
+
+func (md5Hasher) Name() string   { return "md5" }
+func (md5Hasher) New() hash.Hash { return md5.New() }
+
+type sha256Hasher struct{}
+
+func (sha256Hasher) Name() string   { return "sha256" }
+func (sha256Hasher) New() hash.Hash { return sha256.New() }
+
+type xxHasher struct{}
+
+func (xxHasher) Name() string   { return "xxhash" }
+func (xxHasher) New() hash.Hash { return xxhash.New() }
+
+type blake3Hasher struct{}
+
+func (blake3Hasher) Name() string   { return "blake3" }
+func (blake3Hasher) New() hash.Hash { return blake3.New() }
+
+// Hashers the task runner ships with.
+var (
+	MD5    Hasher = md5Hasher{}
+	SHA256 Hasher = sha256Hasher{}
+	XXHash Hasher = xxHasher{}
+	BLAKE3 Hasher = blake3Hasher{}
+)
+
+// DefaultHasher is used for tasks that don't set a hasher of their own.
+var DefaultHasher = XXHash
+
+// AllHashers lists every Hasher a task might be configured with. When a
+// file is large enough to make a second full read expensive, hashFile
+// refreshes the cache for all of them in a single pass instead of just
+// the one it was asked for.
+var AllHashers = []Hasher{MD5, SHA256, XXHash, BLAKE3}
+
+// largeFileThreshold is the size past which hashFile switches from a
+// single-hasher read to the hashFileMulti fan-out.
+const largeFileThreshold = 8 << 20 // 8MiB
+
+// hashCacheBucket is the Storm bucket the (path, mtime, size) -> hash
+// cache is kept in.
+const hashCacheBucket = "hashcache"
+
+// hashCacheEntry records the digest computed for a file the last time it
+// was hashed with a given Hasher, plus the mtime/size it was taken from.
+// If neither has changed, the stored hash can be reused instead of
+// reading the file again.
+type hashCacheEntry struct {
+	ModTime int64
+	Size    int64
+	Hash    string
+}
+
+func hashCacheID(path string, h Hasher) string {
+	return h.Name() + ":" + path
+}
+
+// cachedHash returns the cached digest for path/h if info's mtime and
+// size still match what was recorded when it was last computed.
+func cachedHash(db *storm.DB, path string, h Hasher, info os.FileInfo) (string, bool) {
+	if db == nil {
+		return "", false
+	}
+	var entry hashCacheEntry
+	if err := db.Get(hashCacheBucket, hashCacheID(path, h), &entry); err != nil {
+		return "", false
+	}
+	if entry.ModTime != info.ModTime().UnixNano() || entry.Size != info.Size() {
+		return "", false
+	}
+	return entry.Hash, true
+}
+
+func storeHash(db *storm.DB, path string, h Hasher, info os.FileInfo, sum string) {
+	if db == nil {
+		return
+	}
+	entry := hashCacheEntry{
+		ModTime: info.ModTime().UnixNano(),
+		Size:    info.Size(),
+		Hash:    sum,
+	}
+	if err := db.Set(hashCacheBucket, hashCacheID(path, h), &entry); err != nil {
+		log.Printf("Error saving hash cache entry for %s: %s", path, err)
+	}
+}
+
+// hashFile calculates the hash of path's contents using h, consulting
+// and refreshing the (path, mtime, size) cache in db. A nil db skips the
+// cache entirely. Files that don't exist have invalid hashes.
+//
+// Once path is at least largeFileThreshold, re-reading it once per
+// Hasher a different task happens to use would be wasteful, so hashFile
+// instead reads it once via hashFileMulti and refreshes the cache for
+// every Hasher in AllHashers in that same pass.
+func hashFile(path string, h Hasher, db *storm.DB) string {
+	if !fileExists(path) {
+		return ""
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		log.Fatalf("Error stating file %s: %s", path, err)
+	}
+	if sum, ok := cachedHash(db, path, h, info); ok {
+		return sum
+	}
+
+	if info.Size() >= largeFileThreshold {
+		sums, err := hashFileMulti(path, AllHashers)
+		if err != nil {
+			log.Fatalf("Error hashing file %s: %s", path, err)
+		}
+		for _, other := range AllHashers {
+			storeHash(db, path, other, info, sums[other.Name()])
+		}
+		return sums[h.Name()]
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		log.Fatalf("Error opening file %s: %s", path, err)
+	}
+	defer f.Close()
+
+	hasher := h.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		log.Fatalf("Error reading file %s: %s", path, err)
+	}
+	sum := fmt.Sprintf("%x", hasher.Sum(nil))
+	storeHash(db, path, h, info, sum)
+	return sum
+}
+
+// hashPaths hashes every path in paths with h, returning a map keyed by
+// path. It's used to snapshot a task's targets for the run journal
+// after a successful action.
+func hashPaths(paths mapset.Set, h Hasher, db *storm.DB) map[string]string {
+	result := make(map[string]string, paths.Cardinality())
+	for p := range paths.Iter() {
+		path := p.(string)
+		result[path] = hashFile(path, h, db)
+	}
+	return result
+}
+
+// hashFileMulti reads path once and feeds each chunk to every hasher in
+// turn via io.MultiWriter, so a large file that needs more than one
+// digest (e.g. while migrating from one Hasher to another) only pays
+// for a single pass over its contents.
+func hashFileMulti(path string, hashers []Hasher) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sums := make([]hash.Hash, len(hashers))
+	writers := make([]io.Writer, len(hashers))
+	for i, h := range hashers {
+		sums[i] = h.New()
+		writers[i] = sums[i]
+	}
+
+	if _, err := io.Copy(io.MultiWriter(writers...), f); err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]string, len(hashers))
+	for i, h := range hashers {
+		result[h.Name()] = fmt.Sprintf("%x", sums[i].Sum(nil))
+	}
+	return result, nil
+}
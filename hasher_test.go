@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHashFileCachesUntilContentChanges(t *testing.T) {
+	dir := t.TempDir()
+	db := InitDB(filepath.Join(dir, "test.db"))
+	defer db.Close()
+
+	path := filepath.Join(dir, "input.txt")
+	if err := os.WriteFile(path, []byte("v1"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	first := hashFile(path, DefaultHasher, db)
+	if first == "" {
+		t.Fatal("expected a non-empty hash")
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if cached, ok := cachedHash(db, path, DefaultHasher, info); !ok || cached != first {
+		t.Fatalf("expected cachedHash to return %q, got %q (ok=%v)", first, cached, ok)
+	}
+
+	if err := os.WriteFile(path, []byte("v2"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	second := hashFile(path, DefaultHasher, db)
+	if second == first {
+		t.Fatal("expected the hash to change once the file's contents changed")
+	}
+}
+
+func TestHashFileMissingPathReturnsEmpty(t *testing.T) {
+	db := InitDB(filepath.Join(t.TempDir(), "test.db"))
+	defer db.Close()
+
+	if got := hashFile(filepath.Join(t.TempDir(), "nope.txt"), DefaultHasher, db); got != "" {
+		t.Fatalf("expected empty hash for a missing file, got %q", got)
+	}
+}
+
+// TestHashFileMultiMatchesIndividualHashers confirms the large-file
+// fan-out in hashFileMulti produces the same digest per Hasher as
+// hashing the file individually with each one, so switching between the
+// single-read and multi-read paths in hashFile never changes results.
+func TestHashFileMultiMatchesIndividualHashers(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "big.bin")
+	content := bytes.Repeat([]byte("x"), 1024)
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	got, err := hashFileMulti(path, AllHashers)
+	if err != nil {
+		t.Fatalf("hashFileMulti: %v", err)
+	}
+
+	for _, h := range AllHashers {
+		want := hashFile(path, h, nil)
+		if got[h.Name()] != want {
+			t.Fatalf("hashFileMulti[%s] = %q, want %q", h.Name(), got[h.Name()], want)
+		}
+	}
+}
+
+// TestHashFileLargeFileRefreshesAllHashers exercises the
+// largeFileThreshold branch of hashFile and checks it populates the
+// cache for every Hasher in AllHashers from a single read, not just the
+// one it was asked for.
+func TestHashFileLargeFileRefreshesAllHashers(t *testing.T) {
+	dir := t.TempDir()
+	db := InitDB(filepath.Join(dir, "test.db"))
+	defer db.Close()
+
+	path := filepath.Join(dir, "big.bin")
+	content := bytes.Repeat([]byte("y"), largeFileThreshold)
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	hashFile(path, DefaultHasher, db)
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	for _, h := range AllHashers {
+		if _, ok := cachedHash(db, path, h, info); !ok {
+			t.Fatalf("expected hashFile to populate the cache for %s on a large file", h.Name())
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/asdine/storm"
+)
+
+// JournalRecord is one entry in the run journal: a task starting or
+// finishing, with enough state to diagnose a crash or resume a run
+// without depending on the Storm DB.
+type JournalRecord struct {
+	Task         string            `json:"task"`
+	Event        string            `json:"event"` // "start" or "finish"
+	Time         time.Time         `json:"time"`
+	Success      bool              `json:"success,omitempty"`
+	Error        string            `json:"error,omitempty"`
+	InputHashes  map[string]string `json:"input_hashes,omitempty"`
+	OutputHashes map[string]string `json:"output_hashes,omitempty"`
+}
+
+// RunJournal is an append-only, rotating log of task start/finish
+// events, stored alongside the Storm DB.
+type RunJournal struct {
+	mu         sync.Mutex
+	path       string
+	maxBytes   int64
+	maxBackups int
+	f          *os.File
+	enc        *json.Encoder
+}
+
+// NewRunJournal opens (creating if needed) a rotating journal at path.
+// Once the current file passes maxBytes it's rotated out to path.1,
+// path.2, ... up to maxBackups backups, oldest discarded.
+func NewRunJournal(path string, maxBytes int64, maxBackups int) (*RunJournal, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("opening run journal %s: %w", path, err)
+	}
+	return &RunJournal{
+		path:       path,
+		maxBytes:   maxBytes,
+		maxBackups: maxBackups,
+		f:          f,
+		enc:        json.NewEncoder(f),
+	}, nil
+}
+
+// Start records that a task began running, along with the fileDep
+// hashes it's running against.
+func (j *RunJournal) Start(task string, inputs map[string]string) error {
+	return j.append(JournalRecord{Task: task, Event: "start", Time: time.Now(), InputHashes: inputs})
+}
+
+// Finish records that a task stopped running, successfully or not.
+func (j *RunJournal) Finish(task string, success bool, taskErr error, inputs, outputs map[string]string) error {
+	rec := JournalRecord{
+		Task:         task,
+		Event:        "finish",
+		Time:         time.Now(),
+		Success:      success,
+		InputHashes:  inputs,
+		OutputHashes: outputs,
+	}
+	if taskErr != nil {
+		rec.Error = taskErr.Error()
+	}
+	return j.append(rec)
+}
+
+func (j *RunJournal) append(rec JournalRecord) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := j.enc.Encode(rec); err != nil {
+		return err
+	}
+	return j.rotateIfNeeded()
+}
+
+func (j *RunJournal) rotateIfNeeded() error {
+	info, err := j.f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() < j.maxBytes {
+		return nil
+	}
+	if err := j.f.Close(); err != nil {
+		return err
+	}
+
+	for i := j.maxBackups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", j.path, i), fmt.Sprintf("%s.%d", j.path, i+1))
+	}
+	if j.maxBackups > 0 {
+		os.Rename(j.path, fmt.Sprintf("%s.1", j.path))
+	} else {
+		os.Remove(j.path)
+	}
+
+	f, err := os.OpenFile(j.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	j.f = f
+	j.enc = json.NewEncoder(f)
+	return nil
+}
+
+// Close closes the journal's current file. Rotated backups are left on
+// disk.
+func (j *RunJournal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.f.Close()
+}
+
+// ReplayJournal reads path and up to maxBackups of its rotated backups
+// (oldest first) and reports:
+//   - inFlight: tasks whose last journal record is a "start" with no
+//     matching "finish" - i.e. tasks a crash interrupted.
+//   - completed: the "finish" record of every task whose most recent
+//     "finish" was successful, for --resume to compare against current
+//     hashes. A later failed "finish" drops the task from completed.
+//
+// maxBackups must match the value the journal was opened with via
+// NewRunJournal, or older backups will be missed.
+func ReplayJournal(path string, maxBackups int) (inFlight map[string]bool, completed map[string]JournalRecord, err error) {
+	inFlight = make(map[string]bool)
+	completed = make(map[string]JournalRecord)
+
+	for _, p := range rotatedJournalFiles(path, maxBackups) {
+		if err := replayJournalFile(p, inFlight, completed); err != nil {
+			return nil, nil, fmt.Errorf("replaying run journal %s: %w", p, err)
+		}
+	}
+	return inFlight, completed, nil
+}
+
+// rotatedJournalFiles returns up to maxBackups backups of path (oldest
+// first) followed by path itself, skipping any that don't exist.
+func rotatedJournalFiles(path string, maxBackups int) []string {
+	var files []string
+	for i := maxBackups; i >= 1; i-- {
+		p := fmt.Sprintf("%s.%d", path, i)
+		if fileExists(p) {
+			files = append(files, p)
+		}
+	}
+	if fileExists(path) {
+		files = append(files, path)
+	}
+	return files
+}
+
+func replayJournalFile(path string, inFlight map[string]bool, completed map[string]JournalRecord) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for {
+		var rec JournalRecord
+		if err := dec.Decode(&rec); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		switch rec.Event {
+		case "start":
+			inFlight[rec.Task] = true
+		case "finish":
+			delete(inFlight, rec.Task)
+			if rec.Success {
+				completed[rec.Task] = rec
+			} else {
+				delete(completed, rec.Task)
+			}
+		}
+	}
+}
+
+// forceDirty clears any DepData stored for the tasks in inFlight, so
+// the next ScheduleTasks call treats them as dirty no matter what their
+// current fileDep/target hashes look like. inFlight tasks are the ones
+// a crash left running with unknown results.
+func forceDirty(inFlight map[string]bool, db *storm.DB) {
+	for name := range inFlight {
+		if err := db.Delete("ID", name); err != nil && err != storm.ErrNotFound {
+			log.Printf("Error clearing stale DepData for %s: %s", name, err)
+		}
+	}
+}
+
+// reconcileResume seeds db's DepData for any task whose journal shows a
+// successful completion with fileDep hashes matching the current state
+// of the world, even if db's own DepData entry was lost (e.g. the Storm
+// file didn't survive a crash that the journal did). This is what makes
+// --resume able to skip work a completed journal entry already vouches
+// for.
+func reconcileResume(tasks []Task, completed map[string]JournalRecord, db *storm.DB) {
+	for _, t := range tasks {
+		rec, ok := completed[t.name]
+		if !ok {
+			continue
+		}
+		current := CalculateDepData(t, db).fileHashes
+		// A journaled empty input map decodes as nil, so compare empty
+		// maps by length rather than with DeepEqual.
+		if reflect.DeepEqual(current, rec.InputHashes) || (len(current) == 0 && len(rec.InputHashes) == 0) {
+			UpdateDepData(t, db)
+		}
+	}
+}
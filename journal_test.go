@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/asdine/storm"
+)
+
+func TestReplayJournalTracksInFlightAndCompleted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "run.journal")
+	j, err := NewRunJournal(path, 10<<20, 5)
+	if err != nil {
+		t.Fatalf("NewRunJournal: %v", err)
+	}
+
+	if err := j.Start("A", map[string]string{"in": "h1"}); err != nil {
+		t.Fatalf("Start A: %v", err)
+	}
+	if err := j.Finish("A", true, nil, map[string]string{"in": "h1"}, map[string]string{"out": "h2"}); err != nil {
+		t.Fatalf("Finish A: %v", err)
+	}
+	if err := j.Start("B", map[string]string{"in": "h3"}); err != nil {
+		t.Fatalf("Start B: %v", err)
+	}
+	// B never finishes - simulates a crash mid-task.
+	if err := j.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	inFlight, completed, err := ReplayJournal(path, 5)
+	if err != nil {
+		t.Fatalf("ReplayJournal: %v", err)
+	}
+
+	if !inFlight["B"] {
+		t.Fatalf("expected B to be in-flight, got %v", inFlight)
+	}
+	if inFlight["A"] {
+		t.Fatalf("expected A not to be in-flight, got %v", inFlight)
+	}
+	rec, ok := completed["A"]
+	if !ok || !rec.Success {
+		t.Fatalf("expected a successful completed record for A, got %+v (ok=%v)", rec, ok)
+	}
+	if _, ok := completed["B"]; ok {
+		t.Fatal("expected no completed record for B")
+	}
+}
+
+func TestReplayJournalDropsFailedFromCompleted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "run.journal")
+	j, err := NewRunJournal(path, 10<<20, 5)
+	if err != nil {
+		t.Fatalf("NewRunJournal: %v", err)
+	}
+	defer j.Close()
+
+	if err := j.Start("A", nil); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if err := j.Finish("A", false, errors.New("boom"), nil, nil); err != nil {
+		t.Fatalf("Finish: %v", err)
+	}
+
+	_, completed, err := ReplayJournal(path, 5)
+	if err != nil {
+		t.Fatalf("ReplayJournal: %v", err)
+	}
+	if _, ok := completed["A"]; ok {
+		t.Fatal("expected a failed task not to show up in completed")
+	}
+}
+
+func TestForceDirtyClearsDepData(t *testing.T) {
+	db := InitDB(filepath.Join(t.TempDir(), "test.db"))
+	defer db.Close()
+
+	hashes := map[string]string{"foo": "bar"}
+	if err := db.Set("ID", "A", &hashes); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+
+	forceDirty(map[string]bool{"A": true}, db)
+
+	var out map[string]string
+	if err := db.Get("ID", "A", &out); err != storm.ErrNotFound {
+		t.Fatalf("expected DepData for A to be cleared, got err=%v", err)
+	}
+}
+
+func TestReconcileResumeSeedsMatchingDepData(t *testing.T) {
+	dir := t.TempDir()
+	db := InitDB(filepath.Join(dir, "test.db"))
+	defer db.Close()
+
+	path := filepath.Join(dir, "input.txt")
+	if err := os.WriteFile(path, []byte("hello"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	a := chainTasks(1)[0]
+	a.fileDep.Add(path)
+
+	current := CalculateDepData(a, db).fileHashes
+	completed := map[string]JournalRecord{
+		a.name: {Task: a.name, Event: "finish", Success: true, InputHashes: current},
+	}
+
+	reconcileResume([]Task{a}, completed, db)
+
+	var out map[string]string
+	if err := db.Get("ID", a.name, &out); err != nil {
+		t.Fatalf("expected reconcileResume to seed DepData for %s: %v", a.name, err)
+	}
+}
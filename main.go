@@ -1,12 +1,13 @@
 package main
 
 import (
-	"crypto/md5"
+	"context"
 	"fmt"
-	"io"
 	"log"
 	"os"
 	"runtime/pprof"
+	"sort"
+	"sync"
 
 	"reflect"
 
@@ -24,29 +25,52 @@ type Task struct {
 	targets mapset.Set
 	// taskDep is the set of tasks this task requires be ran BEFORE it
 	taskDep mapset.Set
+	// action is the work this task performs when it is executed
+	action func(ctx context.Context) error
+	// hasher picks the content-hashing algorithm for fileDep; if nil,
+	// DefaultHasher is used instead
+	hasher Hasher
+	// priority breaks ties between ready tasks within the same level;
+	// higher runs first
+	priority float64
+	// maxAttempts is how many times the action is tried before the task
+	// counts as failed; 0 means try once
+	maxAttempts int
+	// trigger controls when the task is eligible to run under a Runner
+	trigger Trigger
 }
 
 //TaskMap is a map of tasks indexed by string
 type TaskMap map[string]Task
 
-// ScheduleTasks sorts tasks on order of execution to satisfy
-// dependencies. It also removes all tasks that have their
-// dependencies unchanged since last successful run.
-func ScheduleTasks(tasks []Task, db *storm.DB) []Task {
+// Levels groups tasks into execution levels: every task in a level has
+// all of its dependencies satisfied by tasks in earlier levels, so the
+// tasks within a single level can safely run concurrently.
+type Levels [][]Task
+
+// buildGraph assembles the toposort graph for tasks, along with the
+// task-name lookup table and the full set of dependency edges (task
+// deps plus fileDep/target edges) keyed by dependent task name. Keeping
+// this adjacency around lets callers reason about the DAG after the
+// sort instead of only seeing the flattened order.
+func buildGraph(tasks []Task) (*toposort.Graph, TaskMap, map[string]mapset.Set) {
 	taskNameMap := make(TaskMap)
 	graph := toposort.NewGraph(len(tasks))
+	deps := make(map[string]mapset.Set)
 
 	for i := range tasks {
-		// Assign unique UUIDs to all tasks
 		taskNameMap[tasks[i].name] = tasks[i]
-		// Create task nodes
 		graph.AddNode(tasks[i].name)
+		deps[tasks[i].name] = mapset.NewSet()
 	}
 
-	// Add edges by task dependency
+	// Add edges by task dependency. AddEdge(from, to) guarantees
+	// index(from) <= index(to), so the dependency must be `from` and the
+	// dependent `to` for the sort to put it first.
 	for _, task := range tasks {
 		for name := range task.taskDep.Iter() {
-			graph.AddEdge(task.name, name.(string))
+			graph.AddEdge(name.(string), task.name)
+			deps[task.name].Add(name.(string))
 		}
 	}
 
@@ -72,14 +96,63 @@ func ScheduleTasks(tasks []Task, db *storm.DB) []Task {
 				log.Fatalf("Path %s is a dependency of task %s and is missing.", path, tasks[i].name)
 			}
 		}
-		// Add edges by fileDep/target relationship
+		// Add edges by fileDep/target relationship: the task producing
+		// the target must come before the task depending on it.
 		for fd := range t1.fileDep.Iter() {
 			if t2id, ok := tasksByTarget[fd.(string)]; ok {
-				graph.AddEdge(t1.name, tasks[t2id].name)
+				graph.AddEdge(tasks[t2id].name, t1.name)
+				deps[t1.name].Add(tasks[t2id].name)
+			}
+		}
+	}
+
+	return graph, taskNameMap, deps
+}
+
+// BuildLevels groups a topologically sorted list of tasks into levels,
+// using deps (as produced by buildGraph) to decide, for each task, how
+// far downstream of the earliest level it can run. A task's level is
+// one past the highest level of any of its dependencies. Within a
+// level, tasks are ordered by descending priority so the executor's
+// worker pool picks up the most important ready work first.
+func BuildLevels(sorted []Task, deps map[string]mapset.Set) Levels {
+	level := make(map[string]int, len(sorted))
+	maxLevel := 0
+	for _, t := range sorted {
+		l := 0
+		for dep := range deps[t.name].Iter() {
+			if depLevel, ok := level[dep.(string)]; ok && depLevel+1 > l {
+				l = depLevel + 1
 			}
 		}
+		level[t.name] = l
+		if l > maxLevel {
+			maxLevel = l
+		}
 	}
 
+	levels := make(Levels, maxLevel+1)
+	for _, t := range sorted {
+		l := level[t.name]
+		levels[l] = append(levels[l], t)
+	}
+	for l := range levels {
+		sort.SliceStable(levels[l], func(i, j int) bool {
+			return levels[l][i].priority > levels[l][j].priority
+		})
+	}
+	return levels
+}
+
+// ScheduleTasks sorts tasks on order of execution to satisfy
+// dependencies, groups them into levels of tasks that can run
+// concurrently, and drops all tasks that have their dependencies
+// unchanged since last successful run. It also returns the dependency
+// edges used to build the levels, so callers can reason about which
+// tasks depend on which once execution starts.
+func ScheduleTasks(tasks []Task, db *storm.DB) (Levels, map[string]mapset.Set) {
+	graph, taskNameMap, deps := buildGraph(tasks)
+
 	// Sort topologically and return
 	fmt.Printf("Sorting\n")
 	nameResults, ok := graph.Toposort()
@@ -87,16 +160,13 @@ func ScheduleTasks(tasks []Task, db *storm.DB) []Task {
 		log.Fatal("Error sorting tasks, cycle detected!")
 	}
 
-	// TODO: Use the sorted graph to create a list of dirty tasks
-
-
 	// Re-map IDs to tasks
 	taskResults := make([]Task, len(tasks))
 	for i := range nameResults {
 		taskResults[i] = taskNameMap[nameResults[i]]
 	}
-	results := FilterTasks(taskResults, db)
-	return results
+	results := FilterTasks(taskResults, deps, db)
+	return BuildLevels(results, deps), deps
 }
 
 // InitDB creates/opens a Storm DB to store up-to-date data
@@ -108,36 +178,39 @@ func InitDB(path string) *storm.DB {
 	return db
 }
 
-// hashFile calculates the md5 hash of a file
-func hashFile(path string) string {
-	// FIles that don't exist have invalud hashes
-	if !fileExists(path) {
-		return ""
-	}
-	f, err := os.Open(path)
-	if err != nil {
-		log.Fatalf("Error opening file %s: %s", path, err)
-	}
-	defer f.Close()
-
-	h := md5.New()
-	if _, err := io.Copy(h, f); err != nil {
-		log.Fatalf("Error reading file %s: %s", path, err)
-	}
-	return fmt.Sprintf("%x", h.Sum(nil))
-}
-
-// FilterTasks takes a list of tasks and return tasks that are not up to date.
-func FilterTasks(tasks []Task, db *storm.DB) []Task {
+// FilterTasks walks tasks (topologically sorted, dependencies before
+// dependents) and keeps only the ones that need to run again: either
+// dirty(t, db) on its own, or because some upstream task it depends on
+// (via taskDep, or a fileDep that is another task's target, per deps)
+// is itself dirty. This is what catches staleness where a regenerated
+// intermediate file happens to match its old hash but the task that
+// produced it actually re-ran. The returned tasks keep dependency
+// order.
+func FilterTasks(tasks []Task, deps map[string]mapset.Set, db *storm.DB) []Task {
+	isDirty := make(map[string]bool, len(tasks))
 	result := make([]Task, 0)
 	for _, t := range tasks {
-		if dirty(t, db) {
+		dirtyTask := dirty(t, db)
+		if !dirtyTask {
+			for dep := range deps[t.name].Iter() {
+				if isDirty[dep.(string)] {
+					dirtyTask = true
+					break
+				}
+			}
+		}
+		isDirty[t.name] = dirtyTask
+		if dirtyTask {
 			result = append(result, t)
 		}
 	}
 	return result
 }
 
+// fileDepWorkers bounds how many fileDeps of a single task are hashed
+// concurrently in CalculateDepData.
+var fileDepWorkers = DefaultWorkers
+
 // DepData describes both a task and its file dependencies state
 type DepData struct {
 	ID         string
@@ -145,12 +218,37 @@ type DepData struct {
 }
 
 // CalculateDepData creates a DepData struct for a given task matching the
-// current state of the universe.
-func CalculateDepData(task Task) DepData {
-	hashes := make(map[string]string)
-	for path := range task.fileDep.Iter() {
-		hashes[path.(string)] = hashFile(path.(string))
+// current state of the universe. Each fileDep is hashed concurrently,
+// using task.hasher (or DefaultHasher) and consulting the hash cache
+// stored in db.
+func CalculateDepData(task Task, db *storm.DB) DepData {
+	hasher := task.hasher
+	if hasher == nil {
+		hasher = DefaultHasher
+	}
+
+	paths := task.fileDep.ToSlice()
+	hashes := make(map[string]string, len(paths))
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, fileDepWorkers)
+
+	for _, p := range paths {
+		path := p.(string)
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			sum := hashFile(path, hasher, db)
+			mu.Lock()
+			hashes[path] = sum
+			mu.Unlock()
+		}()
 	}
+	wg.Wait()
+
 	return DepData{
 		ID:         task.name,
 		fileHashes: hashes,
@@ -169,7 +267,7 @@ func GetLastDepData(task Task, db *storm.DB) DepData {
 
 // UpdateDepData stores current state for a task into the DB
 func UpdateDepData(task Task, db *storm.DB) {
-	data := CalculateDepData(task)
+	data := CalculateDepData(task, db)
 	err := db.Set("ID", task.name, &data.fileHashes)
 	if err != nil {
 		log.Fatal("Error saving data to DB: ", err)
@@ -183,14 +281,16 @@ func fileExists(path string) bool {
 	return true
 }
 
-// dirty calculates if a task needs to run again. That can be because:
+// dirty calculates if a task needs to run again on its own terms. That
+// can be because:
 // * depFiles have changed since last successful run
 // * This task has never run before
 // * The targets of the task don't exist
-// TODO: a dirty task has a target that is a fileDep of this task (and so on)
+// It does not consider whether an upstream task is dirty; FilterTasks
+// propagates that through the dependency graph.
 func dirty(task Task, db *storm.DB) bool {
 	old := GetLastDepData(task, db)
-	new := CalculateDepData(task)
+	new := CalculateDepData(task, db)
 	isDirty := false
 
 	depsChanged := !reflect.DeepEqual(old, new)
@@ -219,7 +319,68 @@ func dirty(task Task, db *storm.DB) bool {
 	return isDirty
 }
 
+// buildDemoTasks builds the sample chain of tasks main uses to exercise
+// the scheduler: task-i depends on the file foo-(i-1) and produces foo-i.
+func buildDemoTasks(count int) []Task {
+	tasks := make([]Task, count)
+	for i := 0; i < count; i++ {
+		i := i
+		tasks[i] = Task{
+			name:    fmt.Sprintf("task-%d", i),
+			fileDep: mapset.NewSet(),
+			targets: mapset.NewSet(),
+			taskDep: mapset.NewSet(),
+			action: func(ctx context.Context) error {
+				fmt.Printf("running task-%d\n", i)
+				return nil
+			},
+		}
+		tasks[i].targets.Add(fmt.Sprintf("foo-%d", i))
+		tasks[i].fileDep.Add(fmt.Sprintf("foo-%d", i-1))
+	}
+	return tasks
+}
+
+// runClean is the `doit clean` subcommand: it prunes DepData,
+// hash-cache, and last-run entries for tasks and paths that are no
+// longer part of the live set.
+func runClean() {
+	db := InitDB("my.db")
+	defer db.Close()
+
+	if err := Prune(db, buildDemoTasks(10000)); err != nil {
+		log.Fatal("Error cleaning DB: ", err)
+	}
+	fmt.Printf("Clean done.\n")
+}
+
+// journalPath is where the run journal is kept, alongside the Storm DB.
+const journalPath = "my.journal"
+
+// journalMaxBackups bounds how many rotated-out journal files are kept
+// and replayed; must stay in sync between NewRunJournal and
+// ReplayJournal.
+const journalMaxBackups = 5
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "clean" {
+		runClean()
+		return
+	}
+
+	resume := false
+	jobFile := ""
+	for i := 1; i < len(os.Args); i++ {
+		switch os.Args[i] {
+		case "--resume":
+			resume = true
+		case "--jobfile":
+			if i+1 < len(os.Args) {
+				i++
+				jobFile = os.Args[i]
+			}
+		}
+	}
 
 	f, err := os.Create("cosa.prof")
 	if err != nil {
@@ -232,26 +393,51 @@ func main() {
 	db.Bolt.NoSync = true
 	defer db.Close()
 
-	count := 10000
+	journal, err := NewRunJournal(journalPath, 10<<20, journalMaxBackups)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer journal.Close()
 
-	tasks := make([]Task, count)
+	inFlight, completed, err := ReplayJournal(journalPath, journalMaxBackups)
+	if err != nil {
+		log.Fatal("Error replaying run journal: ", err)
+	}
+	forceDirty(inFlight, db)
 
-	for i := 0; i < count; i++ {
-		tasks[i] = Task{
-			name:    fmt.Sprintf("task-%d", i),
-			fileDep: mapset.NewSet(),
-			targets: mapset.NewSet(),
-			taskDep: mapset.NewSet(),
+	var tasks []Task
+	if jobFile != "" {
+		tasks, err = LoadTaskFile(jobFile)
+		if err != nil {
+			log.Fatal("Error loading task file: ", err)
 		}
-		tasks[i].targets.Add(fmt.Sprintf("foo-%d", i))
-		tasks[i].fileDep.Add(fmt.Sprintf("foo-%d", i-1))
+	} else {
+		tasks = buildDemoTasks(10000)
+	}
+	if resume {
+		// A task a crash interrupted stays dirty even if an earlier run of
+		// it completed with the same inputs.
+		for name := range inFlight {
+			delete(completed, name)
+		}
+		reconcileResume(tasks, completed, db)
+	}
+
+	fmt.Printf("Scheduling %d tasks\n", len(tasks))
+
+	var runErr error
+	if jobFile != "" {
+		// A job file carries each task's own trigger/priority, so run it
+		// through the Runner instead of the raw scheduler/executor pair.
+		runErr = NewRunner(db, journal).Run(context.Background(), tasks)
+	} else {
+		levels, deps := ScheduleTasks(tasks, db)
+		runErr = Execute(context.Background(), levels, deps, db, DefaultWorkers, journal)
 	}
-	fmt.Printf("Scheduling %d tasks\n", count)
-	// TODO: cleanup tasks that don't exist anymore
-	r := ScheduleTasks(tasks[:], db)
-	for _, t := range r {
-		UpdateDepData(t, db)
-		fmt.Printf("%v(%v) ->", t.name, dirty(t, db))
+	if runErr != nil {
+		log.Print(runErr)
+	} else if err := Prune(db, tasks); err != nil {
+		log.Print("Error pruning DB: ", err)
 	}
 	fmt.Printf("Done.\n")
 }
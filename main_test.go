@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/deckarep/golang-set"
+)
+
+// sortedByGraph runs buildGraph+Toposort on tasks and remaps the result
+// back to Tasks, the same way ScheduleTasks does.
+func sortedByGraph(t *testing.T, tasks []Task) ([]Task, map[string]mapset.Set) {
+	t.Helper()
+	graph, taskNameMap, deps := buildGraph(tasks)
+	names, ok := graph.Toposort()
+	if !ok {
+		t.Fatal("expected a valid topological sort")
+	}
+	sorted := make([]Task, len(names))
+	for i, n := range names {
+		sorted[i] = taskNameMap[n]
+	}
+	return sorted, deps
+}
+
+// chainTasks builds a linear chain of n tasks where task-i's fileDep is
+// task-(i-1)'s target, for i > 0.
+func chainTasks(n int) []Task {
+	tasks := make([]Task, n)
+	for i := 0; i < n; i++ {
+		tasks[i] = Task{
+			name:    fmt.Sprintf("task-%d", i),
+			fileDep: mapset.NewSet(),
+			targets: mapset.NewSet(),
+			taskDep: mapset.NewSet(),
+		}
+		tasks[i].targets.Add(fmt.Sprintf("foo-%d", i))
+		if i > 0 {
+			tasks[i].fileDep.Add(fmt.Sprintf("foo-%d", i-1))
+		}
+	}
+	return tasks
+}
+
+func TestBuildLevelsOrdersFileDepChain(t *testing.T) {
+	tasks := chainTasks(5)
+	sorted, deps := sortedByGraph(t, tasks)
+	levels := BuildLevels(sorted, deps)
+
+	if len(levels) != len(tasks) {
+		t.Fatalf("expected %d levels for a linear chain, got %d: %v", len(tasks), len(levels), levels)
+	}
+	for i, level := range levels {
+		want := fmt.Sprintf("task-%d", i)
+		if len(level) != 1 || level[0].name != want {
+			t.Fatalf("level %d = %v, want only %s", i, level, want)
+		}
+	}
+}
+
+func TestBuildLevelsOrdersTaskDepChain(t *testing.T) {
+	a := Task{name: "A", fileDep: mapset.NewSet(), targets: mapset.NewSet(), taskDep: mapset.NewSet()}
+	b := Task{name: "B", fileDep: mapset.NewSet(), targets: mapset.NewSet(), taskDep: mapset.NewSet()}
+	b.taskDep.Add("A")
+
+	sorted, deps := sortedByGraph(t, []Task{a, b})
+	levels := BuildLevels(sorted, deps)
+
+	if len(levels) != 2 {
+		t.Fatalf("expected 2 levels, got %d: %v", len(levels), levels)
+	}
+	if len(levels[0]) != 1 || levels[0][0].name != "A" {
+		t.Fatalf("expected level 0 to be just A, got %v", levels[0])
+	}
+	if len(levels[1]) != 1 || levels[1][0].name != "B" {
+		t.Fatalf("expected level 1 to be just B, got %v", levels[1])
+	}
+}
+
+func TestFilterTasksPropagatesDirtyAcrossTaskDep(t *testing.T) {
+	db := InitDB(filepath.Join(t.TempDir(), "test.db"))
+	defer db.Close()
+
+	a := Task{name: "A", fileDep: mapset.NewSet(), targets: mapset.NewSet(), taskDep: mapset.NewSet()}
+	b := Task{name: "B", fileDep: mapset.NewSet(), targets: mapset.NewSet(), taskDep: mapset.NewSet()}
+	b.taskDep.Add("A")
+
+	// B looks up to date on its own terms (it has no fileDeps of its own
+	// to change), but A has never run, so A is dirty. B must inherit
+	// that even though B's own hashes haven't changed.
+	UpdateDepData(b, db)
+
+	sorted, deps := sortedByGraph(t, []Task{a, b})
+	result := FilterTasks(sorted, deps, db)
+
+	if len(result) != 2 {
+		names := make([]string, len(result))
+		for i, r := range result {
+			names[i] = r.name
+		}
+		t.Fatalf("expected both A and B to be dirty, got %v", names)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/asdine/storm"
+	"github.com/deckarep/golang-set"
+	"github.com/willf/bloom"
+	bolt "go.etcd.io/bbolt"
+)
+
+// pruneBuckets lists every Storm bucket keyed by task name or file
+// path, and therefore in need of pruning once a task disappears.
+var pruneBuckets = []string{"ID", hashCacheBucket, lastRunBucket}
+
+// liveKeysFor returns the set of keys considered live in bucketName.
+// The "ID" and lastRunBucket buckets are keyed by bare task name, but
+// hashCacheBucket is keyed by hashCacheID(path, hasher) - a live file
+// path isn't a live hashcache key on its own, it's only live once
+// paired with the Hasher that produced the entry.
+func liveKeysFor(bucketName string, live []Task) mapset.Set {
+	keys := mapset.NewSet()
+	switch bucketName {
+	case hashCacheBucket:
+		for _, t := range live {
+			for p := range t.fileDep.Iter() {
+				for _, h := range AllHashers {
+					keys.Add(hashCacheID(p.(string), h))
+				}
+			}
+			for p := range t.targets.Iter() {
+				for _, h := range AllHashers {
+					keys.Add(hashCacheID(p.(string), h))
+				}
+			}
+		}
+	default:
+		for _, t := range live {
+			keys.Add(t.name)
+		}
+	}
+	return keys
+}
+
+// Prune deletes DepData, hash-cache, and last-run entries that no
+// longer correspond to a live task name or a live fileDep/target path.
+// It builds a bloom filter over the live keys, sized for a 0.1%
+// false-positive rate, to cheaply rule out most entries, then runs an
+// exact membership check against the live set before deleting a
+// candidate - the same bloom-filter-plus-exact-recheck shape
+// go-ethereum uses to prune its state trie without false deletions.
+func Prune(db *storm.DB, live []Task) error {
+	pruned := 0
+	for _, bucketName := range pruneBuckets {
+		liveKeys := liveKeysFor(bucketName, live)
+
+		filter := bloom.NewWithEstimates(uint(liveKeys.Cardinality())+1, 0.001)
+		for k := range liveKeys.Iter() {
+			filter.AddString(k.(string))
+		}
+
+		var stale []string
+		err := db.Bolt.View(func(tx *bolt.Tx) error {
+			bucket := tx.Bucket([]byte(bucketName))
+			if bucket == nil {
+				return nil
+			}
+			return bucket.ForEach(func(k, v []byte) error {
+				key := string(k)
+				if filter.TestString(key) && liveKeys.Contains(key) {
+					return nil
+				}
+				stale = append(stale, key)
+				return nil
+			})
+		})
+		if err != nil {
+			return fmt.Errorf("scanning bucket %s: %w", bucketName, err)
+		}
+
+		for _, key := range stale {
+			if err := db.Delete(bucketName, key); err != nil {
+				return fmt.Errorf("deleting %s/%s: %w", bucketName, key, err)
+			}
+			pruned++
+		}
+	}
+	log.Printf("Pruned %d stale entries", pruned)
+	return nil
+}
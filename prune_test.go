@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/deckarep/golang-set"
+)
+
+// TestPruneKeepsLiveHashCacheEntry guards against Prune wiping the hash
+// cache for every live file: liveKeysFor must test hashcache entries
+// against hashCacheID(path, hasher), not the bare path, or every entry
+// looks stale and gets deleted regardless of the bloom filter.
+func TestPruneKeepsLiveHashCacheEntry(t *testing.T) {
+	dir := t.TempDir()
+	db := InitDB(filepath.Join(dir, "test.db"))
+	defer db.Close()
+
+	path := filepath.Join(dir, "input.txt")
+	if err := os.WriteFile(path, []byte("hello"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	task := Task{name: "A", fileDep: mapset.NewSet(), targets: mapset.NewSet(), taskDep: mapset.NewSet()}
+	task.fileDep.Add(path)
+
+	sum := hashFile(path, DefaultHasher, db)
+	if sum == "" {
+		t.Fatal("expected a non-empty hash for a file that exists")
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if _, ok := cachedHash(db, path, DefaultHasher, info); !ok {
+		t.Fatal("expected the hash to be cached before pruning")
+	}
+
+	if err := Prune(db, []Task{task}); err != nil {
+		t.Fatalf("Prune: %v", err)
+	}
+
+	if _, ok := cachedHash(db, path, DefaultHasher, info); !ok {
+		t.Fatal("expected Prune to keep the cache entry for a live fileDep, but it was deleted")
+	}
+}
+
+// TestPruneDropsStaleHashCacheEntry makes sure Prune still does its job:
+// a hash cached for a path no longer referenced by any live task must be
+// removed.
+func TestPruneDropsStaleHashCacheEntry(t *testing.T) {
+	dir := t.TempDir()
+	db := InitDB(filepath.Join(dir, "test.db"))
+	defer db.Close()
+
+	path := filepath.Join(dir, "orphan.txt")
+	if err := os.WriteFile(path, []byte("bye"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	hashFile(path, DefaultHasher, db)
+
+	if err := Prune(db, nil); err != nil {
+		t.Fatalf("Prune: %v", err)
+	}
+
+	info, _ := os.Stat(path)
+	if _, ok := cachedHash(db, path, DefaultHasher, info); ok {
+		t.Fatal("expected Prune to delete the cache entry for a path no live task references")
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/asdine/storm"
+	"github.com/deckarep/golang-set"
+	"github.com/robfig/cron/v3"
+	"gopkg.in/yaml.v2"
+)
+
+// Trigger controls when a task is eligible to run under a Runner.
+// TriggerAny (the default) means the task runs whenever it's dirty;
+// TriggerOnDemand means Runner never treats it as due (Runner has no
+// way to request a task explicitly);
+// TriggerNightly/TriggerWeekly gate it to once per day/week; any other
+// value is parsed as a standard cron expression.
+type Trigger string
+
+// Built-in triggers; anything else is treated as a cron expression.
+const (
+	TriggerAny      Trigger = "any"
+	TriggerOnDemand Trigger = "on_demand"
+	TriggerNightly  Trigger = "nightly"
+	TriggerWeekly   Trigger = "weekly"
+)
+
+// TaskSpec is the on-disk description of a Task, as loaded from a JSON
+// or YAML job file.
+type TaskSpec struct {
+	Name        string   `json:"name" yaml:"name"`
+	FileDeps    []string `json:"file_deps" yaml:"file_deps"`
+	Targets     []string `json:"targets" yaml:"targets"`
+	TaskDeps    []string `json:"task_deps" yaml:"task_deps"`
+	Command     string   `json:"command" yaml:"command"`
+	MaxAttempts int      `json:"max_attempts" yaml:"max_attempts"`
+	Priority    float64  `json:"priority" yaml:"priority"`
+	Trigger     string   `json:"trigger" yaml:"trigger"`
+}
+
+// JobSpec is a collection of TaskSpecs, the top-level shape of a
+// task file.
+type JobSpec struct {
+	Tasks []TaskSpec `json:"tasks" yaml:"tasks"`
+}
+
+// LoadTaskFile reads a JobSpec from a JSON or YAML file, picking the
+// format by file extension, and converts its TaskSpecs into Tasks ready
+// for ScheduleTasks/Runner.
+func LoadTaskFile(path string) ([]Task, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading task file %s: %w", path, err)
+	}
+
+	var job JobSpec
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".json":
+		err = json.Unmarshal(data, &job)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &job)
+	default:
+		return nil, fmt.Errorf("unsupported task file extension %q", ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing task file %s: %w", path, err)
+	}
+
+	tasks := make([]Task, len(job.Tasks))
+	for i, spec := range job.Tasks {
+		tasks[i] = specToTask(spec)
+	}
+	return tasks, nil
+}
+
+func specToTask(spec TaskSpec) Task {
+	t := Task{
+		name:        spec.Name,
+		fileDep:     mapset.NewSet(),
+		targets:     mapset.NewSet(),
+		taskDep:     mapset.NewSet(),
+		priority:    spec.Priority,
+		maxAttempts: spec.MaxAttempts,
+		trigger:     Trigger(spec.Trigger),
+	}
+	for _, p := range spec.FileDeps {
+		t.fileDep.Add(p)
+	}
+	for _, p := range spec.Targets {
+		t.targets.Add(p)
+	}
+	for _, p := range spec.TaskDeps {
+		t.taskDep.Add(p)
+	}
+	if spec.Command != "" {
+		command := spec.Command
+		t.action = func(ctx context.Context) error {
+			cmd := exec.CommandContext(ctx, "sh", "-c", command)
+			cmd.Stdout = os.Stdout
+			cmd.Stderr = os.Stderr
+			return cmd.Run()
+		}
+	}
+	return t
+}
+
+// lastRunBucket is the Storm bucket last-successful-run timestamps are
+// kept in, used by Runner to evaluate periodic/cron triggers.
+const lastRunBucket = "lastrun"
+
+// runRecord stores the last time a task completed successfully, so
+// periodic and cron triggers know whether they're due again.
+type runRecord struct {
+	When int64
+}
+
+func recordRunTime(db *storm.DB, name string, when time.Time) {
+	if db == nil {
+		return
+	}
+	rec := runRecord{When: when.UnixNano()}
+	if err := db.Set(lastRunBucket, name, &rec); err != nil {
+		log.Printf("Error recording last run for %s: %s", name, err)
+	}
+}
+
+func lastRunTime(db *storm.DB, name string) (time.Time, bool) {
+	if db == nil {
+		return time.Time{}, false
+	}
+	var rec runRecord
+	if err := db.Get(lastRunBucket, name, &rec); err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, rec.When), true
+}
+
+// Runner schedules and executes tasks on behalf of a job file, skipping
+// ones whose trigger isn't due yet.
+type Runner struct {
+	db      *storm.DB
+	workers int
+	journal *RunJournal
+}
+
+// NewRunner creates a Runner backed by db, using DefaultWorkers unless
+// its workers field is changed afterwards. journal may be nil to skip run-journal
+// bookkeeping.
+func NewRunner(db *storm.DB, journal *RunJournal) *Runner {
+	return &Runner{db: db, workers: DefaultWorkers, journal: journal}
+}
+
+// Due reports whether t is eligible to run right now given its trigger
+// and, for periodic/cron triggers, the last time it completed.
+func (r *Runner) Due(t Task, now time.Time) bool {
+	switch t.trigger {
+	case "", TriggerAny:
+		return true
+	case TriggerOnDemand:
+		return false
+	case TriggerNightly:
+		return duePeriod(r.db, t.name, now, 24*time.Hour)
+	case TriggerWeekly:
+		return duePeriod(r.db, t.name, now, 7*24*time.Hour)
+	default:
+		sched, err := cron.ParseStandard(string(t.trigger))
+		if err != nil {
+			log.Printf("Task %s has an invalid trigger %q, running it anyway: %s", t.name, t.trigger, err)
+			return true
+		}
+		last, ok := lastRunTime(r.db, t.name)
+		if !ok {
+			return true
+		}
+		return !sched.Next(last).After(now)
+	}
+}
+
+func duePeriod(db *storm.DB, name string, now time.Time, period time.Duration) bool {
+	last, ok := lastRunTime(db, name)
+	if !ok {
+		return true
+	}
+	return now.Sub(last) >= period
+}
+
+// Run schedules and executes the tasks that are due, level by level,
+// retrying failures per their MaxAttempts/backoff.
+//
+// The graph is built from the full tasks list, not just the due ones:
+// a taskDep on a not-yet-due task (on_demand, or a periodic trigger
+// that hasn't come up) still needs its AddEdge to land on a real node,
+// or the dependency is silently unenforced. Which tasks are due is
+// decided afterwards, by dropping the rest out of the computed levels.
+func (r *Runner) Run(ctx context.Context, tasks []Task) error {
+	levels, deps, due := r.schedule(tasks, time.Now())
+	return Execute(ctx, filterDue(levels, due), deps, r.db, r.workers, r.journal)
+}
+
+// schedule computes levels and deps from the full tasks list alongside
+// the set of task names that are due right now, split out of Run so
+// tests can inspect the graph before due-filtering is applied.
+func (r *Runner) schedule(tasks []Task, now time.Time) (Levels, map[string]mapset.Set, map[string]bool) {
+	due := make(map[string]bool, len(tasks))
+	for _, t := range tasks {
+		if r.Due(t, now) {
+			due[t.name] = true
+		}
+	}
+	levels, deps := ScheduleTasks(tasks, r.db)
+	return levels, deps, due
+}
+
+// filterDue drops any task not in due from levels, keeping the level
+// structure (and therefore the ordering buildGraph computed from the
+// full task list) intact for whatever remains.
+func filterDue(levels Levels, due map[string]bool) Levels {
+	filtered := make(Levels, len(levels))
+	for i, level := range levels {
+		for _, t := range level {
+			if due[t.name] {
+				filtered[i] = append(filtered[i], t)
+			}
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/deckarep/golang-set"
+)
+
+// TestRunnerScheduleKeepsOnDemandTaskDepInGraph guards against Runner.Run
+// filtering tasks down to the due set before calling ScheduleTasks: if an
+// on_demand task is dropped before the graph is built, graph.AddEdge for
+// any taskDep naming it silently no-ops (the dependency was never
+// registered as a node), and the dependent ends up scheduled at level 0
+// as if the dependency didn't exist.
+func TestRunnerScheduleKeepsOnDemandTaskDepInGraph(t *testing.T) {
+	db := InitDB(filepath.Join(t.TempDir(), "test.db"))
+	defer db.Close()
+
+	a := Task{name: "A", fileDep: mapset.NewSet(), targets: mapset.NewSet(), taskDep: mapset.NewSet(), trigger: TriggerOnDemand}
+	b := Task{name: "B", fileDep: mapset.NewSet(), targets: mapset.NewSet(), taskDep: mapset.NewSet()}
+	b.taskDep.Add("A")
+
+	r := NewRunner(db, nil)
+	levels, deps, due := r.schedule([]Task{a, b}, time.Now())
+
+	if due["A"] {
+		t.Fatal("expected on_demand task A to not be due")
+	}
+	if !due["B"] {
+		t.Fatal("expected default-trigger task B to be due")
+	}
+	if !deps["B"].Contains("A") {
+		t.Fatalf("expected B's dependency on A to be tracked, got %v", deps["B"])
+	}
+	if len(levels) != 2 || len(levels[1]) != 1 || levels[1][0].name != "B" {
+		t.Fatalf("expected B to be scheduled at level 1, after A, got levels=%v", levels)
+	}
+
+	filtered := filterDue(levels, due)
+	if len(filtered[0]) != 0 {
+		t.Fatalf("expected on_demand A to be dropped from level 0, got %v", filtered[0])
+	}
+	if len(filtered[1]) != 1 || filtered[1][0].name != "B" {
+		t.Fatalf("expected B to remain scheduled at level 1, got %v", filtered[1])
+	}
+}
+
+// TestRunnerRunSkipsOnDemandTask exercises Run end-to-end: with an
+// on_demand dependency that's never requested, only the due task's
+// action should execute.
+func TestRunnerRunSkipsOnDemandTask(t *testing.T) {
+	db := InitDB(filepath.Join(t.TempDir(), "test.db"))
+	defer db.Close()
+
+	var ran []string
+	record := func(name string) func(context.Context) error {
+		return func(context.Context) error {
+			ran = append(ran, name)
+			return nil
+		}
+	}
+
+	a := Task{name: "A", fileDep: mapset.NewSet(), targets: mapset.NewSet(), taskDep: mapset.NewSet(), trigger: TriggerOnDemand, action: record("A"), maxAttempts: 1}
+	b := Task{name: "B", fileDep: mapset.NewSet(), targets: mapset.NewSet(), taskDep: mapset.NewSet(), action: record("B"), maxAttempts: 1}
+	b.taskDep.Add("A")
+
+	r := NewRunner(db, nil)
+	if err := r.Run(context.Background(), []Task{a, b}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	if len(ran) != 1 || ran[0] != "B" {
+		t.Fatalf("expected only B to run, got %v", ran)
+	}
+}